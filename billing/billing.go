@@ -0,0 +1,48 @@
+// Package billing records each Gemini call's token and image usage to BigQuery, so
+// admins can attribute spend per Slack user and team.
+package billing
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Row is one Gemini call's usage, inserted into the configured BigQuery table.
+type Row struct {
+	TeamID       string    `bigquery:"team_id"`
+	UserID       string    `bigquery:"user_id"`
+	Channel      string    `bigquery:"channel"`
+	Model        string    `bigquery:"model"`
+	PromptTokens int       `bigquery:"prompt_tokens"`
+	OutputTokens int       `bigquery:"output_tokens"`
+	ImageCount   int       `bigquery:"image_count"`
+	CreatedAt    time.Time `bigquery:"created_at"`
+}
+
+// Client wraps a BigQuery client scoped to the usage table.
+type Client struct {
+	bq    *bigquery.Client
+	table *bigquery.Table
+}
+
+func NewClient(ctx context.Context, projectID, datasetID, tableID string) (*Client, error) {
+	bq, err := bigquery.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{bq: bq, table: bq.Dataset(datasetID).Table(tableID)}, nil
+}
+
+func (c *Client) Close() error {
+	return c.bq.Close()
+}
+
+// Record inserts a usage row. row.CreatedAt is set to now if left zero.
+func (c *Client) Record(ctx context.Context, row Row) error {
+	if row.CreatedAt.IsZero() {
+		row.CreatedAt = time.Now()
+	}
+	return c.table.Inserter().Put(ctx, row)
+}
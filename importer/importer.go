@@ -0,0 +1,315 @@
+// Package importer ingests Slack workspace export ZIPs (the channels.json/users.json/
+// {channel}/{date}.json layout Slack produces) into the conversation store's
+// knowledge base, so the bot can ground answers in historical channel content.
+package importer
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"github.com/CRaLFa/slack-gemini-bot/store"
+	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
+	"github.com/cloudevents/sdk-go/v2/event"
+	"google.golang.org/genai"
+)
+
+// chunkSize bounds how many runes of a reconstructed thread go into one embedded chunk.
+const chunkSize = 2000
+
+var (
+	geminiAPIKey string
+	projectID    string
+	isDebug      bool
+
+	reChannelFile = regexp.MustCompile(`^([^/]+)/\d{4}-\d{2}-\d{2}\.json$`)
+	reUserMention = regexp.MustCompile(`<@(\w+)>`)
+	reChanMention = regexp.MustCompile(`<#(\w+)(?:\|[^>]*)?>`)
+)
+
+func init() {
+	geminiAPIKey = os.Getenv("GEMINI_API_KEY")
+	projectID = os.Getenv("PROJECT_ID")
+	isDebug, _ = strconv.ParseBool(os.Getenv("DEBUG"))
+
+	functions.CloudEvent("Import", Import)
+}
+
+// storageObjectData mirrors the subset of a GCS object-finalize CloudEvent payload
+// the importer needs.
+type storageObjectData struct {
+	Bucket string `json:"bucket"`
+	Name   string `json:"name"`
+}
+
+type exportUser struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Profile struct {
+		DisplayName string `json:"display_name"`
+		RealName    string `json:"real_name"`
+	} `json:"profile"`
+}
+
+type exportChannel struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type exportFile struct {
+	URLPrivateDownload string `json:"url_private_download"`
+	Name               string `json:"name"`
+}
+
+type exportMessage struct {
+	Type     string       `json:"type"`
+	SubType  string       `json:"subtype"`
+	User     string       `json:"user"`
+	Text     string       `json:"text"`
+	TS       string       `json:"ts"`
+	ThreadTS string       `json:"thread_ts"`
+	Files    []exportFile `json:"files"`
+}
+
+// Import is triggered by a GCS finalize event on a `.zip` upload and ingests the
+// Slack export it contains into the vector store.
+func Import(ctx context.Context, e event.Event) error {
+	var data storageObjectData
+	if err := e.DataAs(&data); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	if !strings.HasSuffix(data.Name, ".zip") {
+		return nil
+	}
+	if isDebug {
+		fmt.Printf("Importing gs://%s/%s\n", data.Bucket, data.Name)
+	}
+
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	defer gcs.Close()
+
+	body, err := readObject(ctx, gcs, data.Bucket, data.Name)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+
+	users, channels, err := readWorkspaceMeta(zr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+
+	gemini, err := genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey: geminiAPIKey,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+
+	storeClient, err := store.NewClient(ctx, projectID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	defer storeClient.Close()
+
+	teamID := strings.TrimSuffix(data.Name, ".zip")
+
+	for _, f := range zr.File {
+		m := reChannelFile.FindStringSubmatch(f.Name)
+		if m == nil {
+			continue
+		}
+		channelName := m[1]
+		channelID := channelName
+		for _, ch := range channels {
+			if ch.Name == channelName {
+				channelID = ch.ID
+				break
+			}
+		}
+
+		msgs, err := readMessages(f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to read", f.Name, err)
+			continue
+		}
+
+		for _, chunk := range chunkThreads(msgs, users, channels) {
+			if err := ingestChunk(ctx, gemini, storeClient, teamID, channelID, chunk); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to ingest chunk:", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func readObject(ctx context.Context, gcs *storage.Client, bucket, name string) ([]byte, error) {
+	r, err := gcs.Bucket(bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func readWorkspaceMeta(zr *zip.Reader) (map[string]exportUser, map[string]exportChannel, error) {
+	users := map[string]exportUser{}
+	channels := map[string]exportChannel{}
+
+	for _, f := range zr.File {
+		switch f.Name {
+		case "users.json":
+			var list []exportUser
+			if err := readJSONFile(f, &list); err != nil {
+				return nil, nil, err
+			}
+			for _, u := range list {
+				users[u.ID] = u
+			}
+		case "channels.json":
+			var list []exportChannel
+			if err := readJSONFile(f, &list); err != nil {
+				return nil, nil, err
+			}
+			for _, c := range list {
+				channels[c.ID] = c
+			}
+		}
+	}
+	return users, channels, nil
+}
+
+func readJSONFile(f *zip.File, v any) error {
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return json.NewDecoder(rc).Decode(v)
+}
+
+func readMessages(f *zip.File) ([]exportMessage, error) {
+	var msgs []exportMessage
+	if err := readJSONFile(f, &msgs); err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+// threadChunk is one thread (or standalone message) reconstructed from a day's export
+// file, with mentions resolved to human-readable names.
+type threadChunk struct {
+	ts   string
+	part int
+	text string
+}
+
+// chunkThreads groups messages by thread_ts, resolves <@Uxxx>/<#Cxxx> mentions, notes
+// file attachments, and splits long threads into chunkSize-rune pieces.
+func chunkThreads(msgs []exportMessage, users map[string]exportUser, channels map[string]exportChannel) []threadChunk {
+	byThread := map[string][]exportMessage{}
+	var order []string
+	for _, m := range msgs {
+		if m.Type != "message" || m.SubType != "" {
+			continue
+		}
+		key := m.ThreadTS
+		if key == "" {
+			key = m.TS
+		}
+		if _, ok := byThread[key]; !ok {
+			order = append(order, key)
+		}
+		byThread[key] = append(byThread[key], m)
+	}
+
+	var chunks []threadChunk
+	for _, key := range order {
+		var b strings.Builder
+		for _, m := range byThread[key] {
+			b.WriteString(resolveMentions(m.Text, users, channels))
+			for _, f := range m.Files {
+				fmt.Fprintf(&b, " [attachment: %s]", f.Name)
+			}
+			b.WriteString("\n")
+		}
+		for i, part := range splitChunks(b.String(), chunkSize) {
+			chunks = append(chunks, threadChunk{ts: key, part: i, text: part})
+		}
+	}
+	return chunks
+}
+
+func resolveMentions(text string, users map[string]exportUser, channels map[string]exportChannel) string {
+	text = reUserMention.ReplaceAllStringFunc(text, func(s string) string {
+		id := reUserMention.FindStringSubmatch(s)[1]
+		if u, ok := users[id]; ok {
+			name := u.Profile.DisplayName
+			if name == "" {
+				name = u.Profile.RealName
+			}
+			if name == "" {
+				name = u.Name
+			}
+			return "@" + name
+		}
+		return s
+	})
+	return reChanMention.ReplaceAllStringFunc(text, func(s string) string {
+		id := reChanMention.FindStringSubmatch(s)[1]
+		if c, ok := channels[id]; ok {
+			return "#" + c.Name
+		}
+		return s
+	})
+}
+
+func splitChunks(text string, size int) []string {
+	runes := []rune(strings.TrimSpace(text))
+	if len(runes) == 0 {
+		return nil
+	}
+	var chunks []string
+	for i := 0; i < len(runes); i += size {
+		end := i + size
+		if end > len(runes) {
+			end = len(runes)
+		}
+		chunks = append(chunks, string(runes[i:end]))
+	}
+	return chunks
+}
+
+func ingestChunk(ctx context.Context, gemini *genai.Client, storeClient *store.Client, teamID, channelID string, chunk threadChunk) error {
+	embedding, err := store.EmbedText(ctx, gemini, chunk.text)
+	if err != nil {
+		return err
+	}
+	return storeClient.UpsertKBChunk(ctx, teamID, channelID, chunk.ts, chunk.part, store.KBChunk{
+		Text:      chunk.text,
+		Embedding: embedding,
+	})
+}
@@ -0,0 +1,534 @@
+// Package bot holds the Slack/Gemini event-processing pipeline shared by the Cloud
+// Functions sub.Subscribe handler and the socket-mode local runner in main, so the
+// two entry points can't drift out of feature parity with each other.
+package bot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CRaLFa/slack-gemini-bot/billing"
+	"github.com/CRaLFa/slack-gemini-bot/pub"
+	"github.com/CRaLFa/slack-gemini-bot/store"
+	"github.com/samber/lo"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/slackevents"
+	"google.golang.org/genai"
+)
+
+const (
+	GeminiModel = "gemini-2.0-flash-exp"
+
+	// maxRetrievedTurns bounds how many prior turns are prepended to a chat prompt.
+	maxRetrievedTurns = 8
+	// maxRetrievedKBChunks bounds how many imported knowledge-base chunks are
+	// prepended to a chat prompt.
+	maxRetrievedKBChunks = 4
+
+	// streamUpdateInterval bounds how often a streaming answer's placeholder message
+	// is edited: at most one edit per interval, i.e. up to 120 a minute. This alone
+	// does not keep a stream under Slack's tier-3 rate limit (~50/min/channel).
+	streamUpdateInterval = 500 * time.Millisecond
+)
+
+var generationConfig = &genai.GenerateContentConfig{
+	ResponseModalities: []string{"TEXT", "IMAGE"},
+}
+
+// Sender is the subset of the Slack Web API the pipeline needs to post, edit, and
+// delete messages and read thread context. Both *slack.Client and *socketmode.Client
+// (which embeds *slack.Client) satisfy it, so the Cloud Functions and socket-mode
+// entry points can share one implementation of the pipeline below.
+type Sender interface {
+	PostMessageContext(ctx context.Context, channelID string, options ...slack.MsgOption) (string, string, error)
+	UpdateMessageContext(ctx context.Context, channelID, timestamp string, options ...slack.MsgOption) (string, string, string, error)
+	DeleteMessageContext(ctx context.Context, channelID, timestamp string) (string, string, error)
+	GetConversationRepliesContext(ctx context.Context, params *slack.GetConversationRepliesParameters) ([]slack.Message, bool, string, error)
+	UploadFileV2Context(ctx context.Context, params slack.UploadFileV2Parameters) (*slack.FileSummary, error)
+}
+
+// Bot bundles the dependencies the event-processing pipeline needs, decoupled from
+// how its caller receives events (Cloud Functions Pub/Sub vs. socket mode) and from
+// which Slack client posts the replies.
+type Bot struct {
+	Sender    Sender
+	Gemini    *genai.Client
+	Store     *store.Client
+	BotUserID string
+	// BotToken authenticates the file fetches GetBlobs makes against files.slack.com.
+	BotToken string
+	// Billing, if set, additionally records each call's usage to BigQuery for
+	// per-user/team cost attribution. Quota enforcement works without it.
+	Billing *billing.Client
+	Debug   bool
+}
+
+// ProcessAPIEvent answers an app_mention or message event: a top-level mention/DM
+// gets a single-turn streamed answer, a threaded reply gets a chat answer grounded
+// in that thread's retrieved history. Before calling Gemini it enforces event.User's
+// quota, replying in-thread with a reset time instead if it's exhausted. For a
+// threaded reply, the quota check happens inside generateChatAnswer, after the gate
+// that silently ignores replies that don't directly follow a bot message — otherwise an
+// over-quota user would make the bot speak up in threads it would normally ignore.
+func (b *Bot) ProcessAPIEvent(ctx context.Context, event *pub.APIInnerEvent) {
+	switch event.Type {
+	case string(slackevents.AppMention):
+		if b.Debug {
+			fmt.Printf("AppMentionEvent: %#v\n", event)
+		}
+		postOptions := []slack.MsgOption{slack.MsgOptionTS(event.TimeStamp)}
+		if !b.checkQuota(ctx, event, postOptions) {
+			return
+		}
+		answer, blobs, usage := b.generateAnswer(ctx, event.Channel, postOptions, b.removeMention(event.Text), event.FileURLs)
+		b.RecordUsage(ctx, event, usage, len(blobs))
+		if len(blobs) > 0 {
+			b.uploadFile(ctx, event, answer, &blobs[0], true)
+		}
+	case string(slackevents.Message):
+		if b.Debug {
+			fmt.Printf("MessageEvent: %#v\n", event)
+		}
+		if event.ThreadTimeStamp == "" {
+			// メンションもしくはダイレクトメッセージ
+			isMentionToBot := strings.Contains(event.Text, "<@"+b.BotUserID+">")
+			if event.ChannelType == slack.TYPE_CHANNEL && !isMentionToBot {
+				return
+			}
+			var postOptions []slack.MsgOption
+			if isMentionToBot {
+				postOptions = append(postOptions, slack.MsgOptionTS(event.TimeStamp))
+			}
+			if !b.checkQuota(ctx, event, postOptions) {
+				return
+			}
+			answer, blobs, usage := b.generateAnswer(ctx, event.Channel, postOptions, b.removeMention(event.Text), event.FileURLs)
+			b.RecordUsage(ctx, event, usage, len(blobs))
+			if len(blobs) > 0 {
+				b.uploadFile(ctx, event, answer, &blobs[0], isMentionToBot)
+			}
+		} else {
+			// スレッド内のメッセージ
+			postOptions := []slack.MsgOption{slack.MsgOptionTS(event.ThreadTimeStamp)}
+			answer, blobs, usage := b.generateChatAnswer(ctx, event, postOptions, b.removeMention(event.Text), event.FileURLs)
+			b.RecordUsage(ctx, event, usage, len(blobs))
+			if len(blobs) > 0 {
+				b.uploadFile(ctx, event, answer, &blobs[0], true)
+			}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unsupported innerEvent type:", event.Type)
+	}
+}
+
+// checkQuota reports whether event.User may make another Gemini call, against both
+// their own quota and event.Channel's aggregate quota, posting a friendly in-thread
+// denial with the reset time if either is exhausted.
+func (b *Bot) checkQuota(ctx context.Context, event *pub.APIInnerEvent, postOptions []slack.MsgOption) bool {
+	allowed, resetAt, err := b.Store.CheckQuota(ctx, event.User, event.Channel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to check quota:", err)
+		return true
+	}
+	if allowed {
+		return true
+	}
+	options := append(append([]slack.MsgOption{}, postOptions...),
+		slack.MsgOptionText(fmt.Sprintf("You've hit your Gemini usage limit. Try again after %s.", resetAt.Format(time.Kitchen)), false))
+	if _, _, err := b.Sender.PostMessageContext(ctx, event.Channel, options...); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to post quota denial:", err)
+	}
+	return false
+}
+
+// RecordUsage persists a completed call's token/image counts to Store's per-user and
+// per-channel quota counters and, if Billing is configured, to its BigQuery sink. usage is nil
+// when a caller never actually reached Gemini (empty prompt, thread gate miss, quota
+// denial, ...), in which case there's nothing to record. Shared by ProcessAPIEvent and
+// sub's slash-command/interaction handlers so the two entry points record usage identically.
+func (b *Bot) RecordUsage(ctx context.Context, event *pub.APIInnerEvent, usage *genai.GenerateContentResponseUsageMetadata, images int) {
+	if usage == nil {
+		return
+	}
+	promptTokens := int(usage.PromptTokenCount)
+	outputTokens := int(usage.CandidatesTokenCount)
+	if err := b.Store.RecordUsage(ctx, event.User, event.Channel, promptTokens+outputTokens, images); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to record usage:", err)
+	}
+	if b.Billing == nil {
+		return
+	}
+	if err := b.Billing.Record(ctx, billing.Row{
+		TeamID:       event.TeamID,
+		UserID:       event.User,
+		Channel:      event.Channel,
+		Model:        GeminiModel,
+		PromptTokens: promptTokens,
+		OutputTokens: outputTokens,
+		ImageCount:   images,
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to record billing usage:", err)
+	}
+}
+
+func (b *Bot) removeMention(text string) string {
+	mention := "<@" + b.BotUserID + ">"
+	return strings.TrimSpace(strings.ReplaceAll(text, mention, ""))
+}
+
+// createBlocks renders a finished Gemini answer with Regenerate/Continue/Translate
+// follow-up buttons. The buttons carry messageTS rather than the answer text itself,
+// since a non-trivial answer routinely exceeds Slack's 2000-character cap on a
+// block-action button value; processInteraction looks up the (prompt, answer) pair
+// saved under messageTS to act on them.
+func createBlocks(text, messageTS string) slack.MsgOption {
+	textBlock := slack.NewTextBlockObject(slack.MarkdownType, text, false, false)
+	actions := slack.NewActionBlock("",
+		slack.NewButtonBlockElement("regenerate", messageTS, slack.NewTextBlockObject(slack.PlainTextType, "Regenerate", false, false)),
+		slack.NewButtonBlockElement("continue", messageTS, slack.NewTextBlockObject(slack.PlainTextType, "Continue", false, false)),
+		slack.NewButtonBlockElement("translate", messageTS, slack.NewTextBlockObject(slack.PlainTextType, "Translate", false, false)),
+	)
+	return slack.MsgOptionBlocks(slack.NewSectionBlock(textBlock, nil, nil), actions)
+}
+
+// createStreamingBlocks renders an in-progress answer with a Stop button that cancels
+// the stream writing to messageTS.
+func createStreamingBlocks(text, messageTS string) slack.MsgOption {
+	textBlock := slack.NewTextBlockObject(slack.MarkdownType, text, false, false)
+	actions := slack.NewActionBlock("",
+		slack.NewButtonBlockElement("stop", messageTS, slack.NewTextBlockObject(slack.PlainTextType, "Stop", false, false)),
+	)
+	return slack.MsgOptionBlocks(slack.NewSectionBlock(textBlock, nil, nil), actions)
+}
+
+// generateAnswer streams a single-turn Gemini answer straight into a Slack message,
+// editing it incrementally as tokens arrive.
+func (b *Bot) generateAnswer(
+	ctx context.Context,
+	channel string,
+	postOptions []slack.MsgOption,
+	prompt string,
+	fileURLs []string,
+) (string, []genai.Blob, *genai.GenerateContentResponseUsageMetadata) {
+	if prompt == "" {
+		return "", nil, nil
+	}
+	parts := []*genai.Part{{
+		Text: prompt,
+	}}
+	for _, blob := range b.GetBlobs(ctx, fileURLs) {
+		parts = append(parts, &genai.Part{
+			InlineData: &blob,
+		})
+	}
+	contents := []*genai.Content{{
+		Parts: parts,
+		Role:  "user",
+	}}
+	stream := b.Gemini.Models.GenerateContentStream(ctx, GeminiModel, contents, generationConfig)
+	return b.streamAnswer(ctx, channel, postOptions, prompt, stream)
+}
+
+// generateChatAnswer retrieves the turns and knowledge-base chunks most relevant to
+// prompt, then streams a chat answer straight into a Slack message.
+func (b *Bot) generateChatAnswer(
+	ctx context.Context,
+	event *pub.APIInnerEvent,
+	postOptions []slack.MsgOption,
+	prompt string,
+	fileURLs []string,
+) (string, []genai.Blob, *genai.GenerateContentResponseUsageMetadata) {
+	if prompt == "" {
+		return "", nil, nil
+	}
+	channel, threadTS := event.Channel, event.ThreadTimeStamp
+
+	// Cheap gate: only continue a thread when the message right before this one is the
+	// bot's own. The rest of
+	// the history comes from the conversation store below, not from the thread itself.
+	// No Limit here: Slack returns replies oldest-first, so paginating would cut off
+	// the newest messages — exactly the ones this check needs to see.
+	msgs, _, _, err := b.Sender.GetConversationRepliesContext(ctx, &slack.GetConversationRepliesParameters{
+		ChannelID: channel,
+		Timestamp: threadTS,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to get thread content:", err)
+		return "", nil, nil
+	}
+	if len(msgs) < 2 || msgs[len(msgs)-2].User != b.BotUserID {
+		return "", nil, nil
+	}
+
+	if !b.checkQuota(ctx, event, postOptions) {
+		return "", nil, nil
+	}
+
+	queryEmbedding, err := store.EmbedText(ctx, b.Gemini, prompt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to embed prompt:", err)
+	}
+
+	turns, err := b.Store.RelevantTurns(ctx, channel, threadTS, queryEmbedding, maxRetrievedTurns)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to retrieve conversation history:", err)
+	}
+	summary, err := b.Store.Summary(ctx, channel, threadTS)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to fetch conversation summary:", err)
+	}
+	kbChunks, err := b.Store.SearchKB(ctx, event.TeamID, channel, queryEmbedding, maxRetrievedKBChunks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to search knowledge base:", err)
+	}
+	history := createChatHistory(turns, summary, kbChunks)
+
+	parts := []genai.Part{{
+		Text: prompt,
+	}}
+	for _, blob := range b.GetBlobs(ctx, fileURLs) {
+		parts = append(parts, genai.Part{
+			InlineData: &blob,
+		})
+	}
+
+	chat, err := b.Gemini.Chats.Create(ctx, GeminiModel, generationConfig, history)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to create chat:", err)
+		return "", nil, nil
+	}
+
+	answer, blobs, usage := b.streamAnswer(ctx, channel, postOptions, prompt, chat.SendMessageStream(ctx, parts...))
+
+	if err := b.Store.AppendTurn(ctx, channel, threadTS, store.Turn{
+		UserMsg:       prompt,
+		ModelMsg:      answer,
+		UserEmbedding: queryEmbedding,
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to persist conversation turn:", err)
+	}
+	if err := b.Store.CompactIfNeeded(ctx, b.Gemini, GeminiModel, channel, threadTS); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to compact conversation history:", err)
+	}
+
+	return answer, blobs, usage
+}
+
+// streamAnswer posts a placeholder message, then edits it roughly every
+// streamUpdateInterval as chunks arrive from stream, coalescing partial deltas. A
+// "Stop" button on the placeholder sets the cancellation flag streamAnswer polls, so
+// the user can abort and keep whatever text has streamed in so far. On completion it
+// does a final edit with the full markdown-normalized text and Regenerate/Continue/
+// Translate buttons, saving (prompt, answer) under the message's timestamp so those
+// buttons can act on it later.
+func (b *Bot) streamAnswer(
+	ctx context.Context,
+	channel string,
+	postOptions []slack.MsgOption,
+	prompt string,
+	stream iter.Seq2[*genai.GenerateContentResponse, error],
+) (string, []genai.Blob, *genai.GenerateContentResponseUsageMetadata) {
+	placeholder := append(append([]slack.MsgOption{}, postOptions...), slack.MsgOptionText("_Thinking..._", false))
+	_, ts, err := b.Sender.PostMessageContext(ctx, channel, placeholder...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to post placeholder message:", err)
+		return "", nil, nil
+	}
+
+	var textBuf strings.Builder
+	var blobs []genai.Blob
+	var usage *genai.GenerateContentResponseUsageMetadata
+	lastUpdate := time.Now()
+	cancelled := false
+
+	for res, err := range stream {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to get Gemini's response:", err)
+			break
+		}
+		chunkText, chunkBlobs := JoinResponse(res, b.Debug)
+		textBuf.WriteString(chunkText)
+		blobs = append(blobs, chunkBlobs...)
+		if res.UsageMetadata != nil {
+			usage = res.UsageMetadata
+		}
+
+		if time.Since(lastUpdate) >= streamUpdateInterval {
+			if ok, _ := b.Store.IsCancelled(ctx, ts); ok {
+				cancelled = true
+				break
+			}
+			if _, _, _, err := b.Sender.UpdateMessageContext(ctx, channel, ts, createStreamingBlocks(textBuf.String(), ts)); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to update streaming message:", err)
+			}
+			lastUpdate = time.Now()
+		}
+	}
+
+	answer := textBuf.String()
+	if len(blobs) > 0 {
+		// Image output isn't edited in place; uploadFile posts it as its own message.
+		if _, _, err := b.Sender.DeleteMessageContext(ctx, channel, ts); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to delete placeholder message:", err)
+		}
+		return answer, blobs, usage
+	}
+	if answer == "" {
+		if _, _, err := b.Sender.DeleteMessageContext(ctx, channel, ts); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to delete placeholder message:", err)
+		}
+		return "", nil, usage
+	}
+	if cancelled {
+		answer += "\n\n_[stopped]_"
+	}
+	if err := b.Store.SaveAnswerContext(ctx, ts, store.AnswerContext{Prompt: prompt, Answer: answer}); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to save answer context:", err)
+	}
+	if _, _, _, err := b.Sender.UpdateMessageContext(ctx, channel, ts, createBlocks(answer, ts)); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to finalize message:", err)
+	}
+	return answer, nil, usage
+}
+
+func (b *Bot) uploadFile(ctx context.Context, event *pub.APIInnerEvent, answer string, blob *genai.Blob, isReply bool) {
+	buf := bytes.NewBuffer(blob.Data)
+	name := fmt.Sprintf("file_%d.%s", time.Now().Unix(), filepath.Base(blob.MIMEType))
+	params := slack.UploadFileV2Parameters{
+		FileSize: buf.Len(),
+		Reader:   buf,
+		Filename: name,
+		Title:    name,
+		Channel:  event.Channel,
+	}
+	if answer != "" {
+		params.InitialComment = answer
+	}
+	if isReply {
+		params.ThreadTimestamp = lo.Ternary(event.ThreadTimeStamp == "", event.TimeStamp, event.ThreadTimeStamp)
+	}
+	if _, err := b.Sender.UploadFileV2Context(ctx, params); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to upload file:", err)
+	}
+}
+
+// GetBlobs concurrently downloads urls (authenticating against files.slack.com with
+// BotToken) and returns them as inline Gemini blobs with sniffed MIME types.
+func (b *Bot) GetBlobs(ctx context.Context, urls []string) []genai.Blob {
+	var wg sync.WaitGroup
+	wg.Add(len(urls))
+	ch := make(chan []byte)
+	for _, url := range urls {
+		go b.fetchFile(ctx, url, &wg, ch)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+
+	var blobs []genai.Blob
+	for data := range ch {
+		blobs = append(blobs, genai.Blob{
+			MIMEType: http.DetectContentType(data),
+			Data:     data,
+		})
+	}
+	return blobs
+}
+
+func (b *Bot) fetchFile(ctx context.Context, url string, wg *sync.WaitGroup, ch chan<- []byte) {
+	defer wg.Done()
+	if url == "" {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+b.BotToken)
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "Failed to fetch file data:", string(body))
+		return
+	}
+	ch <- body
+}
+
+// JoinResponse flattens a Gemini response's candidates into Slack-ready markdown text
+// and any inline image blobs it returned.
+func JoinResponse(res *genai.GenerateContentResponse, debug bool) (string, []genai.Blob) {
+	reList := regexp.MustCompile(`(\n+\s*)\* `)
+	replaceMarkdown := func(s string) string {
+		if debug {
+			fmt.Printf("%q\n", s)
+		}
+		s = reList.ReplaceAllString(s, "${1}- ")
+		s = strings.ReplaceAll(s, "**", "*")
+		return s
+	}
+
+	var strBuf []string
+	var blobs []genai.Blob
+	for _, cand := range res.Candidates {
+		if cand == nil {
+			continue
+		}
+		for _, part := range cand.Content.Parts {
+			if part.Text != "" {
+				strBuf = append(strBuf, replaceMarkdown(part.Text))
+			}
+			if part.InlineData != nil {
+				blobs = append(blobs, *part.InlineData)
+			}
+		}
+	}
+	return strings.Join(strBuf, "\n"), blobs
+}
+
+// createChatHistory turns retrieved turns (and, if present, the rolling summary of
+// older turns compaction has folded away) into Gemini chat history.
+func createChatHistory(turns []store.Turn, summary string, kbChunks []store.KBChunk) []*genai.Content {
+	history := make([]*genai.Content, 0, len(turns)*2+len(kbChunks)+1)
+	if summary != "" {
+		history = append(history, &genai.Content{
+			Parts: []*genai.Part{{Text: "Earlier conversation summary: " + summary}},
+			Role:  "user",
+		})
+	}
+	for _, k := range kbChunks {
+		history = append(history, &genai.Content{
+			Parts: []*genai.Part{{Text: "Relevant past channel history: " + k.Text}},
+			Role:  "user",
+		})
+	}
+	for _, t := range turns {
+		history = append(history,
+			&genai.Content{Parts: []*genai.Part{{Text: t.UserMsg}}, Role: "user"},
+			&genai.Content{Parts: []*genai.Part{{Text: t.ModelMsg}}, Role: "model"},
+		)
+	}
+	return history
+}
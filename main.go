@@ -6,22 +6,21 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"regexp"
-	"strings"
 
-	"github.com/google/generative-ai-go/genai"
+	"github.com/CRaLFa/slack-gemini-bot/billing"
+	"github.com/CRaLFa/slack-gemini-bot/internal/bot"
+	"github.com/CRaLFa/slack-gemini-bot/pub"
+	"github.com/CRaLFa/slack-gemini-bot/store"
+	"github.com/jinzhu/copier"
 	"github.com/joho/godotenv"
+	"github.com/samber/lo"
 	"github.com/slack-go/slack"
 	"github.com/slack-go/slack/slackevents"
 	"github.com/slack-go/slack/socketmode"
-	"google.golang.org/api/option"
+	"google.golang.org/genai"
 )
 
-var (
-	isDebug   = flag.Bool("d", false, "enable debug mode")
-	reMention = regexp.MustCompile(`<@\w+>`)
-	botUser   string
-)
+var isDebug = flag.Bool("d", false, "enable debug mode")
 
 func main() {
 	flag.Parse()
@@ -31,31 +30,57 @@ func main() {
 	}
 	slackBotToken := os.Getenv("SLACK_BOT_TOKEN")
 	slackAppToken := os.Getenv("SLACK_APP_TOKEN")
-	geminiApiKey := os.Getenv("GEMINI_API_KEY")
+	geminiAPIKey := os.Getenv("GEMINI_API_KEY")
+	projectID := os.Getenv("PROJECT_ID")
+	billingDatasetID := os.Getenv("BILLING_DATASET_ID")
+	billingTableID := os.Getenv("BILLING_TABLE_ID")
 
 	api := slack.New(slackBotToken, slack.OptionAppLevelToken(slackAppToken), slack.OptionDebug(*isDebug))
 	res, err := api.AuthTest()
 	if err != nil {
 		log.Fatal(err)
 	}
-	botUser = res.UserID
 	socketClient := socketmode.New(api, socketmode.OptionDebug(*isDebug))
 
 	ctx := context.Background()
 
-	geminiClient, err := genai.NewClient(ctx, option.WithAPIKey(geminiApiKey))
+	gemini, err := genai.NewClient(ctx, &genai.ClientConfig{
+		APIKey: geminiAPIKey,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	storeClient, err := store.NewClient(ctx, projectID)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer geminiClient.Close()
+	defer storeClient.Close()
+
+	var billingClient *billing.Client
+	if billingDatasetID != "" && billingTableID != "" {
+		billingClient, err = billing.NewClient(ctx, projectID, billingDatasetID, billingTableID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer billingClient.Close()
+	}
 
-	model := geminiClient.GenerativeModel("gemini-1.5-flash")
+	b := &bot.Bot{
+		Sender:    socketClient,
+		Gemini:    gemini,
+		Store:     storeClient,
+		Billing:   billingClient,
+		BotUserID: res.UserID,
+		BotToken:  slackBotToken,
+		Debug:     *isDebug,
+	}
 
-	go processSocketEvent(&ctx, api, socketClient, model)
+	go processSocketEvent(ctx, socketClient, b)
 	socketClient.Run()
 }
 
-func processSocketEvent(ctx *context.Context, api *slack.Client, client *socketmode.Client, model *genai.GenerativeModel) {
+func processSocketEvent(ctx context.Context, client *socketmode.Client, b *bot.Bot) {
 	for envelope := range client.Events {
 		switch envelope.Type {
 		case socketmode.EventTypeEventsAPI:
@@ -65,117 +90,49 @@ func processSocketEvent(ctx *context.Context, api *slack.Client, client *socketm
 				fmt.Printf("Not an Event API event: %+v\n", envelope)
 				continue
 			}
-			switch payload.Type {
-			case slackevents.CallbackEvent:
-				switch event := payload.InnerEvent.Data.(type) {
-				case *slackevents.AppMentionEvent:
-					client.Debugf("AppMentionEvent: %+v\n", event)
-					prompt := strings.TrimSpace(reMention.ReplaceAllLiteralString(event.Text, ""))
-					answer := generateAnswer(ctx, model, prompt)
-					if answer == "" {
-						continue
-					}
-					client.PostMessageContext(*ctx, event.Channel, slack.MsgOptionText(answer, false), slack.MsgOptionTS(event.TimeStamp))
-				case *slackevents.MessageEvent:
-					client.Debugf("MessageEvent: %+v\n", event)
-					if event.User == botUser || (event.ChannelType == "channel" && event.ThreadTimeStamp == "") {
-						continue
-					}
-					prompt := strings.TrimSpace(reMention.ReplaceAllLiteralString(event.Text, ""))
-					var answer string
-					var options []slack.MsgOption
-					if event.ThreadTimeStamp == "" {
-						answer = generateAnswer(ctx, model, prompt)
-						if answer == "" {
-							continue
-						}
-						options = append(options, slack.MsgOptionText(answer, false))
-						if reMention.MatchString(event.Text) {
-							options = append(options, slack.MsgOptionTS(event.TimeStamp))
-						}
-					} else {
-						params := &slack.GetConversationRepliesParameters{
-							ChannelID: event.Channel,
-							Timestamp: event.ThreadTimeStamp,
-						}
-						answer = generateChatAnswer(ctx, api, params, model, prompt)
-						if answer == "" {
-							continue
-						}
-						options = append(options, slack.MsgOptionText(answer, false), slack.MsgOptionTS(event.ThreadTimeStamp))
-					}
-					client.PostMessageContext(*ctx, event.Channel, options...)
-				default:
-					fmt.Printf("Unsupported innerEvent type: %s\n", payload.InnerEvent.Type)
-				}
-			default:
-				fmt.Printf("Unsupported payload type: %s\n", payload.Type)
+			event := toAPIInnerEvent(&payload, b.BotUserID)
+			if event == nil {
+				continue
 			}
+			b.ProcessAPIEvent(ctx, event)
 		default:
 			fmt.Printf("Unsupported event type: %s\n", envelope.Type)
 		}
 	}
 }
 
-func generateAnswer(ctx *context.Context, model *genai.GenerativeModel, prompt string) string {
-	if prompt == "" {
-		return ""
-	}
-	res, err := model.GenerateContent(*ctx, genai.Text(prompt))
-	if err != nil {
-		fmt.Printf("Failed to get Gemini's response: %+v", err)
-		return ""
-	}
-	return joinResponse(res)
-}
-
-func generateChatAnswer(
-	ctx *context.Context,
-	api *slack.Client,
-	params *slack.GetConversationRepliesParameters,
-	model *genai.GenerativeModel,
-	prompt string,
-) string {
-	if prompt == "" {
-		return ""
-	}
-	msgs, _, _, err := api.GetConversationRepliesContext(*ctx, params)
-	if err != nil {
-		fmt.Printf("Failed to get thread content: %+v", err)
-		return ""
-	}
-	chat := model.StartChat()
-	chat.History = createChatHistory(msgs)
-	res, err := chat.SendMessage(*ctx, genai.Text(prompt))
-	if err != nil {
-		fmt.Printf("Failed to get Gemini's response: %+v", err)
-		return ""
+// toAPIInnerEvent mirrors pub's Events API handling for the socket-mode path. Unlike
+// pub, which only forwards message events over Pub/Sub, socket mode receives
+// app_mention events directly and answers them itself.
+func toAPIInnerEvent(payload *slackevents.EventsAPIEvent, botUser string) *pub.APIInnerEvent {
+	if payload.Type != slackevents.CallbackEvent {
+		fmt.Printf("Unsupported payload type: %s\n", payload.Type)
+		return nil
 	}
-	return joinResponse(res)
-}
 
-func createChatHistory(msgs []slack.Message) []*genai.Content {
-	history := []*genai.Content{}
-	for _, msg := range msgs {
-		content := &genai.Content{
-			Parts: []genai.Part{
-				genai.Text(msg.Text),
-			},
-			Role: "user",
+	switch innerEvent := payload.InnerEvent.Data.(type) {
+	case *slackevents.AppMentionEvent:
+		e := pub.APIInnerEvent{Kind: pub.KindEvent, TeamID: payload.TeamID}
+		copier.Copy(&e, &innerEvent)
+		return &e
+	case *slackevents.MessageEvent:
+		if innerEvent.User == botUser {
+			return nil
 		}
-		history = append(history, content)
-	}
-	return history
-}
-
-func joinResponse(res *genai.GenerateContentResponse) string {
-	var buf []string
-	for _, cand := range res.Candidates {
-		if cand != nil {
-			for _, part := range cand.Content.Parts {
-				buf = append(buf, fmt.Sprintf("%v", part))
-			}
+		if innerEvent.ChannelType == slack.TYPE_CHANNEL && innerEvent.ThreadTimeStamp == "" {
+			// Socket mode delivers both an AppMentionEvent and a MessageEvent for the
+			// same top-level channel mention; the AppMention case above already
+			// answers it, so drop this one to avoid answering it twice.
+			return nil
 		}
+		e := pub.APIInnerEvent{Kind: pub.KindEvent, TeamID: payload.TeamID}
+		copier.Copy(&e, &innerEvent)
+		e.FileURLs = lo.Map(innerEvent.Files, func(f slackevents.File, _ int) string {
+			return f.URLPrivateDownload
+		})
+		return &e
+	default:
+		fmt.Printf("Unsupported innerEvent type: %s\n", payload.InnerEvent.Type)
+		return nil
 	}
-	return strings.Join(buf, "\n")
 }
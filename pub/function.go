@@ -8,9 +8,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
@@ -20,8 +24,28 @@ import (
 	"github.com/slack-go/slack/slackevents"
 )
 
+// Kind discriminates the three shapes of Slack request pub forwards over Pub/Sub.
+const (
+	KindEvent       = "event"
+	KindCommand     = "command"
+	KindInteraction = "interaction"
+)
+
+// ModalCallbackID, ModalBlockID, ModalInputActionID, and ModalSubmitActionID
+// identify the `/gemini ask` modal's view and its one input field, shared between
+// the view sub builds (in its askModalView) and the view_submission this package parses
+// back into an APIInnerEvent.
+const (
+	ModalCallbackID     = "gemini_ask_modal"
+	ModalBlockID        = "gemini_ask_prompt_block"
+	ModalInputActionID  = "gemini_ask_prompt_input"
+	ModalSubmitActionID = "gemini_ask_submit"
+)
+
 type APIInnerEvent struct {
+	Kind            string
 	Type            string
+	TeamID          string
 	Channel         string
 	ChannelType     string
 	User            string
@@ -29,17 +53,45 @@ type APIInnerEvent struct {
 	TimeStamp       string
 	ThreadTimeStamp string
 	FileURLs        []string
+
+	// Command/CommandText/ResponseURL/TriggerID are populated for Kind == KindCommand.
+	Command     string
+	CommandText string
+	ResponseURL string
+	TriggerID   string
+
+	// ActionID/ActionValue are populated for Kind == KindInteraction.
+	ActionID    string
+	ActionValue string
 }
 
+// eventEnvelope captures just enough of the raw Events API payload to dedupe retries.
+type eventEnvelope struct {
+	EventID string `json:"event_id"`
+}
+
+const (
+	// maxRequestAge is how far X-Slack-Request-Timestamp may drift from now before a
+	// request is rejected as a possible replay.
+	maxRequestAge = 5 * time.Minute
+	// dedupeTTL is how long a seen event_id is remembered to swallow Slack's retries.
+	dedupeTTL = 10 * time.Minute
+)
+
 var (
-	projectID string
-	topicID   string
-	isDebug   bool
+	projectID          string
+	topicID            string
+	isDebug            bool
+	slackSigningSecret string
+
+	seenEvents   = map[string]time.Time{}
+	seenEventsMu sync.Mutex
 )
 
 func init() {
 	projectID = os.Getenv("PROJECT_ID")
 	topicID = os.Getenv("TOPIC_ID")
+	slackSigningSecret = os.Getenv("SLACK_SIGNING_SECRET")
 
 	var err error
 	isDebug, err = strconv.ParseBool(os.Getenv("DEBUG"))
@@ -51,12 +103,27 @@ func init() {
 }
 
 func Publish(w http.ResponseWriter, r *http.Request) {
-	apiEvent := handleRequest(w, r)
-	if apiEvent == nil {
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "No request body")
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	innerEvent := toApiInnerEvent(apiEvent)
+	if err := verifyRequest(r.Header, body); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to verify request:", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var innerEvent *APIInnerEvent
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		innerEvent = handleFormRequest(w, body)
+	} else {
+		innerEvent = handleEventsAPIRequest(w, body, r.Header)
+	}
 	if innerEvent == nil {
 		return
 	}
@@ -77,16 +144,8 @@ func Publish(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func handleRequest(w http.ResponseWriter, r *http.Request) *slackevents.EventsAPIEvent {
-	defer r.Body.Close()
-
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "No request body")
-		w.WriteHeader(http.StatusBadRequest)
-		return nil
-	}
-
+// handleEventsAPIRequest handles the Events API (app_mention/message) shape of request.
+func handleEventsAPIRequest(w http.ResponseWriter, body []byte, header http.Header) *APIInnerEvent {
 	event, err := slackevents.ParseEvent(json.RawMessage(body), slackevents.OptionNoVerifyToken())
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -104,7 +163,80 @@ func handleRequest(w http.ResponseWriter, r *http.Request) *slackevents.EventsAP
 		return nil
 	}
 
-	return &event
+	if isRetry(body, header) {
+		if isDebug {
+			fmt.Println("Dropping duplicate/retried event:", header.Get("X-Slack-Retry-Num"))
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	return toApiInnerEvent(&event)
+}
+
+// handleFormRequest handles application/x-www-form-urlencoded requests, which cover
+// both slash commands and interactive component payloads (buttons, modals).
+func handleFormRequest(w http.ResponseWriter, body []byte) *APIInnerEvent {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return nil
+	}
+
+	if payload := form.Get("payload"); payload != "" {
+		return toInteractionEvent(w, []byte(payload))
+	}
+	return toCommandEvent(form)
+}
+
+// verifyRequest validates the X-Slack-Signature HMAC and rejects stale requests that
+// could be replays, per Slack's request-verification spec.
+func verifyRequest(header http.Header, body []byte) error {
+	ts := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp: %w", err)
+	}
+	if age := time.Since(time.Unix(sec, 0)); age < -maxRequestAge || age > maxRequestAge {
+		return fmt.Errorf("timestamp out of range: %s", ts)
+	}
+
+	sv, err := slackevents.NewSecretsVerifier(header, slackSigningSecret)
+	if err != nil {
+		return err
+	}
+	if _, err := sv.Write(body); err != nil {
+		return err
+	}
+	return sv.Ensure()
+}
+
+// isRetry reports whether body's event_id has already been seen recently, so Slack's
+// at-least-3s retry on a slow response doesn't trigger a second Gemini call.
+func isRetry(body []byte, header http.Header) bool {
+	var env eventEnvelope
+	if err := json.Unmarshal(body, &env); err != nil || env.EventID == "" {
+		return false
+	}
+
+	seenEventsMu.Lock()
+	defer seenEventsMu.Unlock()
+
+	now := time.Now()
+	for id, seenAt := range seenEvents {
+		if now.Sub(seenAt) > dedupeTTL {
+			delete(seenEvents, id)
+		}
+	}
+
+	if _, ok := seenEvents[env.EventID]; ok {
+		if isDebug {
+			fmt.Println("Retry-Num:", header.Get("X-Slack-Retry-Num"))
+		}
+		return true
+	}
+	seenEvents[env.EventID] = now
+	return false
 }
 
 func toApiInnerEvent(event *slackevents.EventsAPIEvent) *APIInnerEvent {
@@ -126,7 +258,7 @@ func toApiInnerEvent(event *slackevents.EventsAPIEvent) *APIInnerEvent {
 		if isDebug {
 			fmt.Printf("MessageEvent: %#v\n", innerEvent)
 		}
-		e := APIInnerEvent{}
+		e := APIInnerEvent{Kind: KindEvent, TeamID: event.TeamID}
 		copier.Copy(&e, &innerEvent)
 		e.FileURLs = lo.Map(innerEvent.Files, func(f slackevents.File, _ int) string {
 			return f.URLPrivateDownload
@@ -138,6 +270,82 @@ func toApiInnerEvent(event *slackevents.EventsAPIEvent) *APIInnerEvent {
 	}
 }
 
+// toCommandEvent builds an APIInnerEvent out of a slash command submission, e.g.
+// `/gemini summarize #general`.
+func toCommandEvent(form url.Values) *APIInnerEvent {
+	if isDebug {
+		fmt.Printf("SlashCommand: %#v\n", form)
+	}
+	return &APIInnerEvent{
+		Kind:        KindCommand,
+		TeamID:      form.Get("team_id"),
+		Channel:     form.Get("channel_id"),
+		User:        form.Get("user_id"),
+		Command:     form.Get("command"),
+		CommandText: form.Get("text"),
+		ResponseURL: form.Get("response_url"),
+		TriggerID:   form.Get("trigger_id"),
+	}
+}
+
+// toInteractionEvent builds an APIInnerEvent out of either a block_actions payload
+// (e.g. a "Regenerate"/"Continue"/"Translate" button under a Gemini answer) or a
+// view_submission payload (the `/gemini ask` modal's submit button).
+func toInteractionEvent(w http.ResponseWriter, payload []byte) *APIInnerEvent {
+	var cb slack.InteractionCallback
+	if err := json.Unmarshal(payload, &cb); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil
+	}
+	if isDebug {
+		fmt.Printf("InteractionCallback: %#v\n", cb)
+	}
+
+	switch {
+	case cb.Type == slack.InteractionTypeViewSubmission:
+		return toModalSubmitEvent(&cb)
+	case len(cb.ActionCallback.BlockActions) > 0:
+		action := cb.ActionCallback.BlockActions[0]
+		return &APIInnerEvent{
+			Kind:        KindInteraction,
+			TeamID:      cb.Team.ID,
+			Channel:     cb.Channel.ID,
+			User:        cb.User.ID,
+			Text:        cb.Message.Text,
+			TimeStamp:   cb.Message.Timestamp,
+			ResponseURL: cb.ResponseURL,
+			TriggerID:   cb.TriggerID,
+			ActionID:    action.ActionID,
+			ActionValue: action.Value,
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unsupported interaction type:", cb.Type)
+		return nil
+	}
+}
+
+// toModalSubmitEvent builds an APIInnerEvent out of the `/gemini ask` modal's
+// view_submission, carrying its prompt as ActionValue, the channel it was opened
+// from (stashed in PrivateMetadata) as Channel, and the view's ID as TimeStamp so the
+// answer can be written back in place with views.update.
+func toModalSubmitEvent(cb *slack.InteractionCallback) *APIInnerEvent {
+	if cb.View.CallbackID != ModalCallbackID {
+		fmt.Fprintln(os.Stderr, "Unsupported view callback_id:", cb.View.CallbackID)
+		return nil
+	}
+	prompt := cb.View.State.Values[ModalBlockID][ModalInputActionID].Value
+
+	return &APIInnerEvent{
+		Kind:        KindInteraction,
+		TeamID:      cb.Team.ID,
+		Channel:     cb.View.PrivateMetadata,
+		User:        cb.User.ID,
+		TimeStamp:   cb.View.ID,
+		ActionID:    ModalSubmitActionID,
+		ActionValue: prompt,
+	}
+}
+
 func publishTopic(ctx context.Context, client *pubsub.Client, innerEvent *APIInnerEvent) error {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(innerEvent); err != nil {
@@ -0,0 +1,435 @@
+// Package store persists multi-turn Slack conversations in Firestore and retrieves
+// the turns most relevant to a new prompt instead of replaying an entire thread.
+package store
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/genai"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// maxTurnsBeforeCompaction is how many turns a thread may accumulate before its
+	// oldest half is summarized away by CompactIfNeeded.
+	maxTurnsBeforeCompaction = 40
+
+	// DefaultEmbeddingModel is the Gemini model used to embed prompts, turns, and
+	// knowledge-base chunks for cosine-similarity retrieval.
+	DefaultEmbeddingModel = "text-embedding-004"
+
+	// HourlyRequestLimit, DailyTokenLimit, and DailyImageLimit bound per-user Gemini
+	// usage. CheckQuota enforces them as fixed-window counters bucketed by hour/day,
+	// which is simpler than a true sliding window and close enough at these limits.
+	HourlyRequestLimit = 30
+	DailyTokenLimit    = 200_000
+	DailyImageLimit    = 20
+
+	// ChannelHourlyRequestLimit, ChannelDailyTokenLimit, and ChannelDailyImageLimit
+	// bound a channel's aggregate Gemini usage across all of its users, on top of
+	// each user's own limits above. Set well above the per-user limits since a busy
+	// channel is expected to have many users calling the bot.
+	ChannelHourlyRequestLimit = 200
+	ChannelDailyTokenLimit    = 1_000_000
+	ChannelDailyImageLimit    = 100
+)
+
+// Turn is one (user, model) exchange persisted for a Slack thread.
+type Turn struct {
+	UserMsg       string    `firestore:"user_msg"`
+	ModelMsg      string    `firestore:"model_msg"`
+	UserEmbedding []float32 `firestore:"user_embedding"`
+	CreatedAt     time.Time `firestore:"created_at"`
+}
+
+// Client wraps a Firestore client scoped to the conversations collection.
+type Client struct {
+	fs *firestore.Client
+}
+
+func NewClient(ctx context.Context, projectID string) (*Client, error) {
+	fs, err := firestore.NewClient(ctx, projectID)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{fs: fs}, nil
+}
+
+func (c *Client) Close() error {
+	return c.fs.Close()
+}
+
+func (c *Client) threadDoc(channel, threadTS string) *firestore.DocumentRef {
+	return c.fs.Collection("conversations").Doc(channel + "_" + threadTS)
+}
+
+// AppendTurn persists a new (user_msg, model_msg, embedding) tuple for a thread.
+func (c *Client) AppendTurn(ctx context.Context, channel, threadTS string, turn Turn) error {
+	turn.CreatedAt = time.Now()
+	_, _, err := c.threadDoc(channel, threadTS).Collection("turns").Add(ctx, turn)
+	return err
+}
+
+// RelevantTurns returns up to topK turns under (channel, threadTS) ranked by cosine
+// similarity of their UserEmbedding to queryEmbedding, oldest-first so they can be
+// fed straight into a chat history.
+func (c *Client) RelevantTurns(ctx context.Context, channel, threadTS string, queryEmbedding []float32, topK int) ([]Turn, error) {
+	iter := c.threadDoc(channel, threadTS).Collection("turns").Documents(ctx)
+	defer iter.Stop()
+
+	var turns []Turn
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var t Turn
+		if err := doc.DataTo(&t); err != nil {
+			return nil, err
+		}
+		turns = append(turns, t)
+	}
+
+	sort.Slice(turns, func(i, j int) bool {
+		return cosineSimilarity(queryEmbedding, turns[i].UserEmbedding) > cosineSimilarity(queryEmbedding, turns[j].UserEmbedding)
+	})
+	if len(turns) > topK {
+		turns = turns[:topK]
+	}
+	sort.Slice(turns, func(i, j int) bool {
+		return turns[i].CreatedAt.Before(turns[j].CreatedAt)
+	})
+	return turns, nil
+}
+
+// Summary returns the rolling compacted summary for a thread, or "" if none exists yet.
+func (c *Client) Summary(ctx context.Context, channel, threadTS string) (string, error) {
+	doc, err := c.threadDoc(channel, threadTS).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return "", nil
+		}
+		return "", err
+	}
+	summary, _ := doc.Data()["summary"].(string)
+	return summary, nil
+}
+
+// RequestCancel marks messageTS as cancelled, so a stream still writing to that
+// message notices and stops. Used by the "Stop" button under a streaming answer.
+func (c *Client) RequestCancel(ctx context.Context, messageTS string) error {
+	_, err := c.fs.Collection("cancellations").Doc(messageTS).Set(ctx, map[string]any{
+		"cancelled": true,
+	})
+	return err
+}
+
+// IsCancelled reports whether RequestCancel has been called for messageTS.
+func (c *Client) IsCancelled(ctx context.Context, messageTS string) (bool, error) {
+	doc, err := c.fs.Collection("cancellations").Doc(messageTS).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	cancelled, _ := doc.Data()["cancelled"].(bool)
+	return cancelled, nil
+}
+
+// AnswerContext is the (prompt, answer) pair behind a finished Gemini reply, keyed by
+// its message timestamp so the Regenerate/Continue/Translate buttons can carry that
+// timestamp as an opaque reference instead of the answer text itself, which routinely
+// exceeds Slack's 2000-character cap on a block-action button value.
+type AnswerContext struct {
+	Prompt string `firestore:"prompt"`
+	Answer string `firestore:"answer"`
+}
+
+// SaveAnswerContext persists messageTS's (prompt, answer) pair for later retrieval by
+// the Regenerate/Continue/Translate buttons attached to that message.
+func (c *Client) SaveAnswerContext(ctx context.Context, messageTS string, answerCtx AnswerContext) error {
+	_, err := c.fs.Collection("answer_contexts").Doc(messageTS).Set(ctx, answerCtx)
+	return err
+}
+
+// AnswerContext returns the (prompt, answer) pair saved by SaveAnswerContext for
+// messageTS.
+func (c *Client) AnswerContext(ctx context.Context, messageTS string) (AnswerContext, error) {
+	doc, err := c.fs.Collection("answer_contexts").Doc(messageTS).Get(ctx)
+	if err != nil {
+		return AnswerContext{}, err
+	}
+	var ac AnswerContext
+	if err := doc.DataTo(&ac); err != nil {
+		return AnswerContext{}, err
+	}
+	return ac, nil
+}
+
+// quotaUsage is one scope's (a user's or a channel's) consumption within a single
+// hour or day bucket.
+type quotaUsage struct {
+	Requests int `firestore:"requests"`
+	Tokens   int `firestore:"tokens"`
+	Images   int `firestore:"images"`
+}
+
+func hourBucket(t time.Time) string { return t.UTC().Format("2006010215") }
+func dayBucket(t time.Time) string  { return t.UTC().Format("20060102") }
+
+func (c *Client) quotaDoc(scope, id, bucket string) *firestore.DocumentRef {
+	return c.fs.Collection("quotas").Doc(scope + "_" + id + "_" + bucket)
+}
+
+func (c *Client) readQuotaUsage(ctx context.Context, scope, id, bucket string) (quotaUsage, error) {
+	doc, err := c.quotaDoc(scope, id, bucket).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return quotaUsage{}, nil
+		}
+		return quotaUsage{}, err
+	}
+	var u quotaUsage
+	if err := doc.DataTo(&u); err != nil {
+		return quotaUsage{}, err
+	}
+	return u, nil
+}
+
+// checkScopeQuota reports whether scope/id may make another Gemini call right now
+// against the given limits. If not, it also returns when its tightest exhausted
+// window resets.
+func (c *Client) checkScopeQuota(ctx context.Context, scope, id string, hourlyRequestLimit, dailyTokenLimit, dailyImageLimit int) (bool, time.Time, error) {
+	now := time.Now()
+	hourly, err := c.readQuotaUsage(ctx, scope, id, hourBucket(now))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if hourly.Requests >= hourlyRequestLimit {
+		return false, now.Truncate(time.Hour).Add(time.Hour), nil
+	}
+	daily, err := c.readQuotaUsage(ctx, scope, id, dayBucket(now))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if daily.Tokens >= dailyTokenLimit || daily.Images >= dailyImageLimit {
+		return false, now.Truncate(24 * time.Hour).Add(24 * time.Hour), nil
+	}
+	return true, time.Time{}, nil
+}
+
+// CheckQuota reports whether userID may make another Gemini call right now, against
+// both its own per-user quota and channelID's aggregate per-channel quota. If not,
+// it also returns when its tightest exhausted window resets.
+func (c *Client) CheckQuota(ctx context.Context, userID, channelID string) (bool, time.Time, error) {
+	allowed, resetAt, err := c.checkScopeQuota(ctx, "user", userID, HourlyRequestLimit, DailyTokenLimit, DailyImageLimit)
+	if err != nil || !allowed {
+		return allowed, resetAt, err
+	}
+	return c.checkScopeQuota(ctx, "channel", channelID, ChannelHourlyRequestLimit, ChannelDailyTokenLimit, ChannelDailyImageLimit)
+}
+
+func (c *Client) recordScopeUsage(ctx context.Context, scope, id string, tokens, images int) error {
+	now := time.Now()
+	if _, err := c.quotaDoc(scope, id, hourBucket(now)).Set(ctx, map[string]any{
+		"requests": firestore.Increment(1),
+	}, firestore.MergeAll); err != nil {
+		return err
+	}
+	_, err := c.quotaDoc(scope, id, dayBucket(now)).Set(ctx, map[string]any{
+		"tokens": firestore.Increment(tokens),
+		"images": firestore.Increment(images),
+	}, firestore.MergeAll)
+	return err
+}
+
+// RecordUsage increments both userID's and channelID's hourly request counters and
+// daily token/image counters after a completed Gemini call.
+func (c *Client) RecordUsage(ctx context.Context, userID, channelID string, tokens, images int) error {
+	if err := c.recordScopeUsage(ctx, "user", userID, tokens, images); err != nil {
+		return err
+	}
+	return c.recordScopeUsage(ctx, "channel", channelID, tokens, images)
+}
+
+// UsageSummary returns userID's current hourly request count and daily token/image
+// counts, for the `/gemini usage` slash command.
+func (c *Client) UsageSummary(ctx context.Context, userID string) (requests, tokens, images int, err error) {
+	now := time.Now()
+	hourly, err := c.readQuotaUsage(ctx, "user", userID, hourBucket(now))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	daily, err := c.readQuotaUsage(ctx, "user", userID, dayBucket(now))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return hourly.Requests, daily.Tokens, daily.Images, nil
+}
+
+// CompactIfNeeded summarizes the oldest half of a thread's turns into the rolling
+// summary once it grows past maxTurnsBeforeCompaction, then deletes those turns, so
+// retrieval stays fast and the context window stays bounded.
+func (c *Client) CompactIfNeeded(ctx context.Context, gemini *genai.Client, model, channel, threadTS string) error {
+	docs, err := c.threadDoc(channel, threadTS).Collection("turns").Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	if len(docs) <= maxTurnsBeforeCompaction {
+		return nil
+	}
+
+	sort.Slice(docs, func(i, j int) bool {
+		var ti, tj Turn
+		docs[i].DataTo(&ti)
+		docs[j].DataTo(&tj)
+		return ti.CreatedAt.Before(tj.CreatedAt)
+	})
+	stale := docs[:len(docs)-maxTurnsBeforeCompaction/2]
+
+	prev, err := c.Summary(ctx, channel, threadTS)
+	if err != nil {
+		return err
+	}
+	var lines []string
+	if prev != "" {
+		lines = append(lines, "Earlier summary: "+prev)
+	}
+	for _, d := range stale {
+		var t Turn
+		if err := d.DataTo(&t); err != nil {
+			return err
+		}
+		lines = append(lines, "User: "+t.UserMsg, "Assistant: "+t.ModelMsg)
+	}
+
+	prompt := "Summarize the key facts and decisions from this conversation so far in a short paragraph:\n" + strings.Join(lines, "\n")
+	contents := []*genai.Content{{
+		Parts: []*genai.Part{{Text: prompt}},
+		Role:  "user",
+	}}
+	res, err := gemini.Models.GenerateContent(ctx, model, contents, nil)
+	if err != nil {
+		return fmt.Errorf("summarize stale turns: %w", err)
+	}
+
+	var summary strings.Builder
+	for _, cand := range res.Candidates {
+		if cand == nil {
+			continue
+		}
+		for _, part := range cand.Content.Parts {
+			summary.WriteString(part.Text)
+		}
+	}
+
+	if _, err := c.threadDoc(channel, threadTS).Set(ctx, map[string]any{
+		"summary": summary.String(),
+	}, firestore.MergeAll); err != nil {
+		return err
+	}
+
+	batch := c.fs.Batch()
+	for _, d := range stale {
+		batch.Delete(d.Ref)
+	}
+	_, err = batch.Commit(ctx)
+	return err
+}
+
+// EmbedText returns the embedding vector for text using Gemini's embedding model.
+func EmbedText(ctx context.Context, gemini *genai.Client, text string) ([]float32, error) {
+	contents := []*genai.Content{{
+		Parts: []*genai.Part{{Text: text}},
+	}}
+	res, err := gemini.Models.EmbedContent(ctx, DefaultEmbeddingModel, contents, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Embeddings) == 0 {
+		return nil, fmt.Errorf("no embeddings returned")
+	}
+	return res.Embeddings[0].Values, nil
+}
+
+// KBChunk is one embedded chunk of historical channel content used to ground answers
+// beyond a thread's own history, ingested by the importer package.
+type KBChunk struct {
+	TeamID    string    `firestore:"team_id"`
+	ChannelID string    `firestore:"channel_id"`
+	Text      string    `firestore:"text"`
+	Embedding []float32 `firestore:"embedding"`
+}
+
+// UpsertKBChunk writes a knowledge-base chunk keyed by (teamID, channelID, ts, part) so
+// re-running an import is idempotent.
+func (c *Client) UpsertKBChunk(ctx context.Context, teamID, channelID, ts string, part int, chunk KBChunk) error {
+	chunk.TeamID = teamID
+	chunk.ChannelID = channelID
+	id := fmt.Sprintf("%s_%s_%s_%d", teamID, channelID, ts, part)
+	_, err := c.fs.Collection("kb_chunks").Doc(id).Set(ctx, chunk)
+	return err
+}
+
+// SearchKB returns up to topK knowledge-base chunks from (teamID, channelID) ranked by
+// cosine similarity of their Embedding to queryEmbedding, so a channel's imported
+// history never grounds another channel's (or team's) conversation.
+func (c *Client) SearchKB(ctx context.Context, teamID, channelID string, queryEmbedding []float32, topK int) ([]KBChunk, error) {
+	iter := c.fs.Collection("kb_chunks").
+		Where("team_id", "==", teamID).
+		Where("channel_id", "==", channelID).
+		Documents(ctx)
+	defer iter.Stop()
+
+	var chunks []KBChunk
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var k KBChunk
+		if err := doc.DataTo(&k); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, k)
+	}
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return cosineSimilarity(queryEmbedding, chunks[i].Embedding) > cosineSimilarity(queryEmbedding, chunks[j].Embedding)
+	})
+	if len(chunks) > topK {
+		chunks = chunks[:topK]
+	}
+	return chunks, nil
+}
+
+func cosineSimilarity(a, b []float32) float64 {
+	if len(a) == 0 || len(b) == 0 || len(a) != len(b) {
+		return 0
+	}
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
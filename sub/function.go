@@ -4,24 +4,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
-	"io"
 	"net/http"
 	"os"
-	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"cloud.google.com/go/pubsub"
+	"github.com/CRaLFa/slack-gemini-bot/billing"
+	"github.com/CRaLFa/slack-gemini-bot/internal/bot"
 	"github.com/CRaLFa/slack-gemini-bot/pub"
+	"github.com/CRaLFa/slack-gemini-bot/store"
 	"github.com/GoogleCloudPlatform/functions-framework-go/functions"
 	"github.com/cloudevents/sdk-go/v2/event"
 	"github.com/samber/lo"
 	"github.com/slack-go/slack"
-	"github.com/slack-go/slack/slackevents"
 	"google.golang.org/genai"
 )
 
@@ -29,13 +28,14 @@ type MessagePublishedData struct {
 	Message pubsub.Message
 }
 
-const geminiModel = "gemini-2.0-flash-exp"
-
 var (
-	slackBotToken string
-	geminiAPIKey  string
-	isDebug       bool
-	botUser       string
+	slackBotToken    string
+	geminiAPIKey     string
+	projectID        string
+	billingDatasetID string
+	billingTableID   string
+	isDebug          bool
+	botUser          string
 
 	generationConfig = &genai.GenerateContentConfig{
 		ResponseModalities: []string{"TEXT", "IMAGE"},
@@ -45,6 +45,9 @@ var (
 func init() {
 	slackBotToken = os.Getenv("SLACK_BOT_TOKEN")
 	geminiAPIKey = os.Getenv("GEMINI_API_KEY")
+	projectID = os.Getenv("PROJECT_ID")
+	billingDatasetID = os.Getenv("BILLING_DATASET_ID")
+	billingTableID = os.Getenv("BILLING_TABLE_ID")
 	isDebug, _ = strconv.ParseBool(os.Getenv("DEBUG"))
 
 	functions.CloudEvent("Subscribe", Subscribe)
@@ -83,287 +86,319 @@ func Subscribe(ctx context.Context, e event.Event) error {
 		return err
 	}
 
-	processEvent(ctx, &event, api, gemini)
-	return nil
-}
+	storeClient, err := store.NewClient(ctx, projectID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return err
+	}
+	defer storeClient.Close()
 
-func processEvent(ctx context.Context, event *pub.APIInnerEvent, api *slack.Client, gemini *genai.Client) {
-	switch event.Type {
-	case string(slackevents.AppMention):
-		if isDebug {
-			fmt.Printf("AppMentionEvent: %#v\n", event)
-		}
-		answer, blobs := generateAnswer(ctx, gemini, removeMention(event.Text), event.FileURLs)
-		if answer == "" && len(blobs) <= 0 {
-			return
-		}
-		if len(blobs) <= 0 {
-			options := []slack.MsgOption{createBlocks(answer), slack.MsgOptionTS(event.TimeStamp)}
-			postMessage(ctx, api, event.Channel, options)
-		} else {
-			uploadFile(ctx, api, event, answer, &blobs[0], true)
-		}
-	case string(slackevents.Message):
-		if isDebug {
-			fmt.Printf("MessageEvent: %#v\n", event)
-		}
-		if event.ThreadTimeStamp == "" {
-			// メンションもしくはダイレクトメッセージ
-			isMentionToBot := strings.Contains(event.Text, "<@"+botUser+">")
-			if event.ChannelType == slack.TYPE_CHANNEL && !isMentionToBot {
-				return
-			}
-			answer, blobs := generateAnswer(ctx, gemini, removeMention(event.Text), event.FileURLs)
-			if answer == "" && len(blobs) <= 0 {
-				return
-			}
-			if len(blobs) <= 0 {
-				options := []slack.MsgOption{createBlocks(answer)}
-				if isMentionToBot {
-					options = append(options, slack.MsgOptionTS(event.TimeStamp))
-				}
-				postMessage(ctx, api, event.Channel, options)
-			} else {
-				uploadFile(ctx, api, event, answer, &blobs[0], isMentionToBot)
-			}
+	var billingClient *billing.Client
+	if billingDatasetID != "" && billingTableID != "" {
+		billingClient, err = billing.NewClient(ctx, projectID, billingDatasetID, billingTableID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to create billing client:", err)
 		} else {
-			// スレッド内のメッセージ
-			params := &slack.GetConversationRepliesParameters{
-				ChannelID: event.Channel,
-				Timestamp: event.ThreadTimeStamp,
-			}
-			answer, blobs := generateChatAnswer(ctx, api, params, gemini, removeMention(event.Text), event.FileURLs)
-			if answer == "" && len(blobs) <= 0 {
-				return
-			}
-			if len(blobs) <= 0 {
-				options := []slack.MsgOption{createBlocks(answer), slack.MsgOptionTS(event.ThreadTimeStamp)}
-				postMessage(ctx, api, event.Channel, options)
-			} else {
-				uploadFile(ctx, api, event, answer, &blobs[0], true)
-			}
+			defer billingClient.Close()
 		}
-	default:
-		fmt.Fprintln(os.Stderr, "Unsupported innerEvent type:", event.Type)
 	}
+
+	b := &bot.Bot{
+		Sender:    api,
+		Gemini:    gemini,
+		Store:     storeClient,
+		Billing:   billingClient,
+		BotUserID: botUser,
+		BotToken:  slackBotToken,
+		Debug:     isDebug,
+	}
+	processEvent(ctx, &event, api, b)
+	return nil
 }
 
-func removeMention(text string) string {
-	mention := "<@" + botUser + ">"
-	return strings.TrimSpace(strings.ReplaceAll(text, mention, ""))
+func processEvent(ctx context.Context, event *pub.APIInnerEvent, api *slack.Client, b *bot.Bot) {
+	switch event.Kind {
+	case pub.KindCommand:
+		processCommand(ctx, event, api, b)
+	case pub.KindInteraction:
+		processInteraction(ctx, event, api, b)
+	default:
+		b.ProcessAPIEvent(ctx, event)
+	}
 }
 
-func createBlocks(text string) slack.MsgOption {
-	textBlock := slack.NewTextBlockObject(slack.MarkdownType, text, false, false)
-	return slack.MsgOptionBlocks(slack.NewSectionBlock(textBlock, nil, nil))
+// commandHandler answers a `/gemini <name> args...` subcommand, returning the text to
+// post back via event.ResponseURL.
+type commandHandler func(ctx context.Context, api *slack.Client, b *bot.Bot, event *pub.APIInnerEvent, args string) string
+
+var commandRegistry = map[string]commandHandler{
+	"summarize": handleSummarizeCommand,
+	"usage":     handleUsageCommand,
+	"ask":       handleAskCommand,
 }
 
-func generateAnswer(
-	ctx context.Context,
-	gemini *genai.Client,
-	prompt string,
-	fileURLs []string,
-) (string, []genai.Blob) {
-	if prompt == "" {
-		return "", nil
+func processCommand(ctx context.Context, event *pub.APIInnerEvent, api *slack.Client, b *bot.Bot) {
+	if isDebug {
+		fmt.Printf("SlashCommand: %#v\n", event)
 	}
-	parts := []*genai.Part{{
-		Text: prompt,
-	}}
-	for _, b := range getBlobs(ctx, fileURLs) {
-		parts = append(parts, &genai.Part{
-			InlineData: &b,
-		})
+	name, args, _ := strings.Cut(strings.TrimSpace(event.CommandText), " ")
+	handler, ok := commandRegistry[name]
+	if !ok {
+		respond(ctx, event.ResponseURL, fmt.Sprintf("Unknown subcommand %q. Available: summarize, usage, ask", name))
+		return
 	}
-	contents := []*genai.Content{{
-		Parts: parts,
-		Role:  "user",
-	}}
-	res, err := gemini.Models.GenerateContent(ctx, geminiModel, contents, generationConfig)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to get Gemini's response:", err)
-		return "", nil
+	if text := handler(ctx, api, b, event, strings.TrimSpace(args)); text != "" {
+		respond(ctx, event.ResponseURL, text)
 	}
-	return joinResponse(res)
 }
 
-func generateChatAnswer(
-	ctx context.Context,
-	api *slack.Client,
-	params *slack.GetConversationRepliesParameters,
-	gemini *genai.Client,
-	prompt string,
-	fileURLs []string,
-) (string, []genai.Blob) {
-	if prompt == "" {
-		return "", nil
+// handleSummarizeCommand implements `/gemini summarize [#channel]`, summarizing the
+// given channel's recent history, or the invoking channel when none is given.
+func handleSummarizeCommand(ctx context.Context, api *slack.Client, b *bot.Bot, event *pub.APIInnerEvent, args string) string {
+	channelID := event.Channel
+	if args != "" {
+		channelID = strings.TrimSuffix(args, ">")
+		channelID = strings.TrimPrefix(channelID, "<#")
+		channelID, _, _ = strings.Cut(channelID, "|")
 	}
 
-	msgs, _, _, err := api.GetConversationRepliesContext(ctx, params)
+	allowed, resetAt, err := b.Store.CheckQuota(ctx, event.User, event.Channel)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to get thread content:", err)
-		return "", nil
+		fmt.Fprintln(os.Stderr, "Failed to check quota:", err)
+	} else if !allowed {
+		return fmt.Sprintf("You've hit your Gemini usage limit. Try again after %s.", resetAt.Format(time.Kitchen))
 	}
-	if msgs[len(msgs)-2].User != botUser {
-		return "", nil
-	}
-	if isDebug {
-		for i, msg := range msgs {
-			fmt.Printf("msgs[%d]: %#v\n", i, msg)
-		}
+
+	res, err := api.GetConversationHistoryContext(ctx, &slack.GetConversationHistoryParameters{
+		ChannelID: channelID,
+		Limit:     100,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to get channel history:", err)
+		return "Sorry, I couldn't read that channel's history."
 	}
-	history := createChatHistory(ctx, msgs)
 
-	parts := []genai.Part{{
-		Text: prompt,
-	}}
-	for _, b := range getBlobs(ctx, fileURLs) {
-		parts = append(parts, genai.Part{
-			InlineData: &b,
-		})
+	lines := lo.Map(res.Messages, func(msg slack.Message, _ int) string {
+		return removeMention(msg.Text)
+	})
+	prompt := "Summarize the following Slack conversation in a few bullet points:\n" + strings.Join(lines, "\n")
+	answer, blobs, usage := generateText(ctx, b, prompt, nil)
+	b.RecordUsage(ctx, event, usage, len(blobs))
+	if answer == "" {
+		return "Sorry, I couldn't summarize that channel."
 	}
+	return answer
+}
 
-	chat, err := gemini.Chats.Create(ctx, geminiModel, generationConfig, history)
+// handleUsageCommand implements `/gemini usage`, reporting the caller's current
+// quota consumption against the limits enforced in internal/bot.
+func handleUsageCommand(ctx context.Context, api *slack.Client, b *bot.Bot, event *pub.APIInnerEvent, args string) string {
+	requests, tokens, images, err := b.Store.UsageSummary(ctx, event.User)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to create chat:", err)
-		return "", nil
+		fmt.Fprintln(os.Stderr, "Failed to get usage summary:", err)
+		return "Sorry, I couldn't look up your usage."
 	}
+	return fmt.Sprintf(
+		"Your current usage:\n- Requests this hour: %d/%d\n- Tokens today: %d/%d\n- Images today: %d/%d",
+		requests, store.HourlyRequestLimit, tokens, store.DailyTokenLimit, images, store.DailyImageLimit,
+	)
+}
 
-	res, err := chat.SendMessage(ctx, parts...)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to get Gemini's response:", err)
-		return "", nil
+// handleAskCommand implements `/gemini ask`, opening a modal for a Gemini prompt
+// instead of answering inline, so the caller isn't limited to a slash command's
+// single-line text. Submitting it answers in place via views.update (handleModalSubmit)
+// and reopens the same input, so a conversation can continue turn by turn without
+// leaving the dialog.
+func handleAskCommand(ctx context.Context, api *slack.Client, b *bot.Bot, event *pub.APIInnerEvent, args string) string {
+	if _, err := api.OpenViewContext(ctx, event.TriggerID, askModalView(event.Channel, "")); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open ask modal:", err)
+		return "Sorry, I couldn't open the prompt dialog."
 	}
-	return joinResponse(res)
+	return ""
 }
 
-func postMessage(ctx context.Context, api *slack.Client, channel string, options []slack.MsgOption) {
-	if _, _, err := api.PostMessageContext(ctx, channel, options...); err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to post message:", err)
+// askModalView builds the `/gemini ask` modal: an optional section showing the
+// previous turn's result, followed by an input for the next prompt.
+func askModalView(channelID, resultText string) slack.ModalViewRequest {
+	var blocks []slack.Block
+	if resultText != "" {
+		blocks = append(blocks, slack.NewSectionBlock(
+			slack.NewTextBlockObject(slack.MarkdownType, resultText, false, false), nil, nil,
+		))
+	}
+
+	promptInput := slack.NewPlainTextInputBlockElement(
+		slack.NewTextBlockObject(slack.PlainTextType, "What should I ask Gemini?", false, false),
+		pub.ModalInputActionID,
+	)
+	promptInput.Multiline = true
+	blocks = append(blocks, slack.NewInputBlock(
+		pub.ModalBlockID, slack.NewTextBlockObject(slack.PlainTextType, "Prompt", false, false), nil, promptInput,
+	))
+
+	return slack.ModalViewRequest{
+		Type:            slack.VTModal,
+		CallbackID:      pub.ModalCallbackID,
+		PrivateMetadata: channelID,
+		Title:           slack.NewTextBlockObject(slack.PlainTextType, "Ask Gemini", false, false),
+		Submit:          slack.NewTextBlockObject(slack.PlainTextType, "Ask", false, false),
+		Close:           slack.NewTextBlockObject(slack.PlainTextType, "Done", false, false),
+		Blocks:          slack.Blocks{BlockSet: blocks},
 	}
 }
 
-func uploadFile(ctx context.Context, api *slack.Client, event *pub.APIInnerEvent, answer string, blob *genai.Blob, isReply bool) {
-	buf := bytes.NewBuffer(blob.Data)
-	name := fmt.Sprintf("file_%d.%s", time.Now().Unix(), filepath.Base(blob.MIMEType))
-	params := slack.UploadFileV2Parameters{
-		FileSize: buf.Len(),
-		Reader:   buf,
-		Filename: name,
-		Title:    name,
-		Channel:  event.Channel,
+// processInteraction handles a block_actions payload from the Regenerate/Continue/
+// Translate/Stop buttons attached to a Gemini answer, or a view_submission payload
+// from the `/gemini ask` modal.
+func processInteraction(ctx context.Context, event *pub.APIInnerEvent, api *slack.Client, b *bot.Bot) {
+	if isDebug {
+		fmt.Printf("Interaction: %#v\n", event)
 	}
-	if answer != "" {
-		params.InitialComment = answer
+
+	if event.ActionID == pub.ModalSubmitActionID {
+		handleModalSubmit(ctx, api, b, event)
+		return
 	}
-	if isReply {
-		params.ThreadTimestamp = lo.Ternary(event.ThreadTimeStamp == "", event.TimeStamp, event.ThreadTimeStamp)
+
+	if event.ActionID == "stop" {
+		if err := b.Store.RequestCancel(ctx, event.ActionValue); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to request cancellation:", err)
+		}
+		return
 	}
-	if _, err := api.UploadFileV2Context(ctx, params); err != nil {
-		fmt.Fprintln(os.Stderr, "Failed to upload file:", err)
+
+	// Regenerate/Continue/Translate carry the source message's timestamp rather than
+	// its (possibly >2000-character) answer text, which Slack caps a button value at.
+	answerCtx, err := b.Store.AnswerContext(ctx, event.ActionValue)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to get answer context:", err)
+		respond(ctx, event.ResponseURL, "Sorry, I couldn't find that answer to act on.")
+		return
 	}
-}
 
-func getBlobs(ctx context.Context, urls []string) []genai.Blob {
-	var wg sync.WaitGroup
-	wg.Add(len(urls))
-	ch := make(chan []byte)
-	for _, url := range urls {
-		go fetchFile(ctx, url, &wg, ch)
-	}
-	go func() {
-		wg.Wait()
-		close(ch)
-	}()
-
-	var blobs []genai.Blob
-	for data := range ch {
-		blobs = append(blobs, genai.Blob{
-			MIMEType: http.DetectContentType(data),
-			Data:     data,
-		})
+	var prompt string
+	switch event.ActionID {
+	case "regenerate":
+		prompt = answerCtx.Prompt
+	case "continue":
+		prompt = "Continue your previous answer:\n" + answerCtx.Answer
+	case "translate":
+		prompt = "Translate the following into Japanese:\n" + answerCtx.Answer
+	default:
+		fmt.Fprintln(os.Stderr, "Unsupported action_id:", event.ActionID)
+		return
+	}
+
+	allowed, resetAt, err := b.Store.CheckQuota(ctx, event.User, event.Channel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to check quota:", err)
+	} else if !allowed {
+		respond(ctx, event.ResponseURL, fmt.Sprintf("You've hit your Gemini usage limit. Try again after %s.", resetAt.Format(time.Kitchen)))
+		return
 	}
-	return blobs
+
+	answer, blobs, usage := generateText(ctx, b, prompt, nil)
+	if answer != "" {
+		respond(ctx, event.ResponseURL, answer)
+	}
+	b.RecordUsage(ctx, event, usage, len(blobs))
 }
 
-func joinResponse(res *genai.GenerateContentResponse) (string, []genai.Blob) {
-	reList := regexp.MustCompile(`(\n+\s*)\* `)
-	replaceMarkdown := func(s string) string {
-		if isDebug {
-			fmt.Printf("%q\n", s)
-		}
-		s = reList.ReplaceAllString(s, "${1}- ")
-		s = strings.ReplaceAll(s, "**", "*")
-		return s
+// handleModalSubmit answers the prompt submitted through the `/gemini ask` modal and
+// writes the result back into the same dialog via views.update (event.TimeStamp
+// carries the view's ID), reopening the prompt input so the conversation can
+// continue turn by turn.
+func handleModalSubmit(ctx context.Context, api *slack.Client, b *bot.Bot, event *pub.APIInnerEvent) {
+	prompt := strings.TrimSpace(event.ActionValue)
+	if prompt == "" {
+		return
 	}
 
-	var strBuf []string
-	var blobs []genai.Blob
-	for _, cand := range res.Candidates {
-		if cand == nil {
-			continue
-		}
-		for _, part := range cand.Content.Parts {
-			if part.Text != "" {
-				strBuf = append(strBuf, replaceMarkdown(part.Text))
-			}
-			if part.InlineData != nil {
-				blobs = append(blobs, *part.InlineData)
-			}
-		}
+	allowed, resetAt, err := b.Store.CheckQuota(ctx, event.User, event.Channel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to check quota:", err)
+	} else if !allowed {
+		updateAskModal(ctx, api, event.TimeStamp, event.Channel, fmt.Sprintf(
+			"You've hit your Gemini usage limit. Try again after %s.", resetAt.Format(time.Kitchen),
+		))
+		return
+	}
+
+	answer, blobs, usage := generateText(ctx, b, prompt, nil)
+	b.RecordUsage(ctx, event, usage, len(blobs))
+	if answer == "" {
+		answer = "Sorry, I couldn't answer that."
 	}
-	return strings.Join(strBuf, "\n"), blobs
+	updateAskModal(ctx, api, event.TimeStamp, event.Channel, answer)
 }
 
-func createChatHistory(ctx context.Context, msgs []slack.Message) []*genai.Content {
-	return lo.Map(msgs[:len(msgs)-1], func(msg slack.Message, _ int) *genai.Content {
-		parts := []*genai.Part{{
-			Text: removeMention(msg.Text),
-		}}
-		if len(msg.Files) > 0 {
-			urls := lo.Map(msg.Files, func(f slack.File, _ int) string {
-				return f.URLPrivateDownload
-			})
-			for _, b := range getBlobs(ctx, urls) {
-				parts = append(parts, &genai.Part{
-					InlineData: &b,
-				})
-			}
-		}
-		return &genai.Content{
-			Parts: parts,
-			Role:  lo.Ternary(msg.User == botUser, "model", "user"),
-		}
-	})
+func updateAskModal(ctx context.Context, api *slack.Client, viewID, channelID, resultText string) {
+	if _, err := api.UpdateViewContext(ctx, askModalView(channelID, resultText), "", "", viewID); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to update ask modal:", err)
+	}
 }
 
-func fetchFile(ctx context.Context, url string, wg *sync.WaitGroup, ch chan<- []byte) {
-	defer wg.Done()
-	if url == "" {
+// respond posts text back to a Slack response_url, used to answer slash commands and
+// interactions after they've already been acked within Slack's 3-second window.
+func respond(ctx context.Context, responseURL, text string) {
+	if responseURL == "" {
 		return
 	}
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	payload, err := json.Marshal(map[string]string{"text": text})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	req.Header.Set("Authorization", "Bearer "+slackBotToken)
-
-	res, err := http.DefaultClient.Do(req)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responseURL, bytes.NewReader(payload))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	defer res.Body.Close()
+	req.Header.Set("Content-Type", "application/json")
 
-	body, err := io.ReadAll(res.Body)
+	res, err := http.DefaultClient.Do(req)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Failed to post to response_url:", err)
 		return
 	}
-	if res.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stderr, "Failed to fetch file data:", string(body))
-		return
+	defer res.Body.Close()
+}
+
+func removeMention(text string) string {
+	mention := "<@" + botUser + ">"
+	return strings.TrimSpace(strings.ReplaceAll(text, mention, ""))
+}
+
+// generateText runs a single non-streaming Gemini completion, for the slash-command
+// and interaction-reply paths that answer via response_url rather than an editable
+// Slack message. It shares internal/bot's blob-fetching and response-joining logic
+// so the two entry points don't carry divergent copies of the same Gemini plumbing.
+func generateText(
+	ctx context.Context,
+	b *bot.Bot,
+	prompt string,
+	fileURLs []string,
+) (string, []genai.Blob, *genai.GenerateContentResponseUsageMetadata) {
+	if prompt == "" {
+		return "", nil, nil
+	}
+	parts := []*genai.Part{{
+		Text: prompt,
+	}}
+	for _, blob := range b.GetBlobs(ctx, fileURLs) {
+		parts = append(parts, &genai.Part{
+			InlineData: &blob,
+		})
+	}
+	contents := []*genai.Content{{
+		Parts: parts,
+		Role:  "user",
+	}}
+	res, err := b.Gemini.Models.GenerateContent(ctx, bot.GeminiModel, contents, generationConfig)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to get Gemini's response:", err)
+		return "", nil, nil
 	}
-	ch <- body
+	text, blobs := bot.JoinResponse(res, isDebug)
+	return text, blobs, res.UsageMetadata
 }